@@ -0,0 +1,75 @@
+package limits
+
+import (
+	"sync"
+	"time"
+)
+
+// AppenderConfig configures the buffering Appender does before flushing
+// accumulated updates via StoreBatch.
+type AppenderConfig struct {
+	// Size is the number of buffered updates for a tenant that triggers an
+	// immediate flush. Zero disables the size trigger.
+	Size int
+	// MaxLatency bounds how long an update can sit in the buffer before
+	// being flushed, even if Size has not been reached. Zero disables the
+	// latency trigger, so only Size and explicit Flush calls apply.
+	MaxLatency time.Duration
+}
+
+// Appender sits on the ingester's producer path and accumulates StoreUpdates
+// per tenant for up to AppenderConfig.MaxLatency or AppenderConfig.Size
+// updates, whichever comes first, before flushing them to a StreamMetadata
+// in a single StoreBatch call.
+type Appender struct {
+	cfg      AppenderConfig
+	metadata StreamMetadata
+
+	mu      sync.Mutex
+	buffers map[string][]StoreUpdate
+	timers  map[string]*time.Timer
+}
+
+// NewAppender returns an Appender that flushes into metadata.
+func NewAppender(metadata StreamMetadata, cfg AppenderConfig) *Appender {
+	return &Appender{
+		cfg:      cfg,
+		metadata: metadata,
+		buffers:  make(map[string][]StoreUpdate),
+		timers:   make(map[string]*time.Timer),
+	}
+}
+
+// Append buffers update for tenant. It flushes immediately once the buffer
+// reaches cfg.Size; otherwise a timer flushes the buffer after
+// cfg.MaxLatency unless Flush is called first.
+func (a *Appender) Append(tenant string, update StoreUpdate) {
+	a.mu.Lock()
+	a.buffers[tenant] = append(a.buffers[tenant], update)
+	full := a.cfg.Size > 0 && len(a.buffers[tenant]) >= a.cfg.Size
+	if !full && a.cfg.MaxLatency > 0 && a.timers[tenant] == nil {
+		a.timers[tenant] = time.AfterFunc(a.cfg.MaxLatency, func() { a.Flush(tenant) })
+	}
+	a.mu.Unlock()
+
+	if full {
+		a.Flush(tenant)
+	}
+}
+
+// Flush immediately sends any buffered updates for tenant to the underlying
+// StreamMetadata, cancelling the tenant's pending latency timer if any.
+func (a *Appender) Flush(tenant string) {
+	a.mu.Lock()
+	updates := a.buffers[tenant]
+	delete(a.buffers, tenant)
+	if t := a.timers[tenant]; t != nil {
+		t.Stop()
+		delete(a.timers, tenant)
+	}
+	a.mu.Unlock()
+
+	if len(updates) > 0 {
+		a.metadata.StoreBatch(tenant, updates)
+	}
+}
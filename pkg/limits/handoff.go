@@ -0,0 +1,58 @@
+package limits
+
+import "context"
+
+// ExportRequest asks a handoff peer for the state of the given partitions
+// across all tenants, ahead of a graceful rebalance.
+type ExportRequest struct {
+	Partitions []int32
+}
+
+// ExportResponse carries the exported state. State is keyed the same way as
+// StreamMetadata.Export: tenant -> partitionID -> streamHash -> Stream.
+type ExportResponse struct {
+	State map[string]map[int32]map[uint64]Stream
+}
+
+// ImportRequest carries state produced by a peer's Export call, to be merged
+// into the receiving replica.
+type ImportRequest struct {
+	State map[string]map[int32]map[uint64]Stream
+}
+
+// ImportResponse is empty; Import has no result besides success/error.
+type ImportResponse struct{}
+
+// HandoffServer is the gRPC-facing surface used to transfer partition state
+// between limiter replicas during a rebalance: the outgoing replica calls
+// Export on itself and Import on the incoming replica (or vice versa) before
+// either side calls EvictPartitions, so that stream counts and rate buckets
+// carry over instead of resetting.
+//
+// The owning service registers an implementation of this interface with its
+// gRPC server and dials peers using the client generated from the same
+// proto definitions; that wiring lives alongside the rest of the ingest
+// limits service, not in this package.
+type HandoffServer interface {
+	Export(ctx context.Context, req *ExportRequest) (*ExportResponse, error)
+	Import(ctx context.Context, req *ImportRequest) (*ImportResponse, error)
+}
+
+// handoffServer implements HandoffServer on top of a StreamMetadata.
+type handoffServer struct {
+	metadata StreamMetadata
+}
+
+// NewHandoffServer returns a HandoffServer backed by metadata.
+func NewHandoffServer(metadata StreamMetadata) HandoffServer {
+	return &handoffServer{metadata: metadata}
+}
+
+func (h *handoffServer) Export(_ context.Context, req *ExportRequest) (*ExportResponse, error) {
+	return &ExportResponse{State: h.metadata.Export(req.Partitions)}, nil
+}
+
+func (h *handoffServer) Import(_ context.Context, req *ImportRequest) (*ImportResponse, error) {
+	h.metadata.Import(req.State)
+	return &ImportResponse{}, nil
+}
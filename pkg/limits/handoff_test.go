@@ -0,0 +1,45 @@
+package limits
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeImportedStreamIdempotent(t *testing.T) {
+	base := Stream{
+		Hash:        1,
+		LastSeenAt:  10,
+		TotalSize:   100,
+		RateBuckets: []RateBucket{{Timestamp: 0, Size: 100}},
+	}
+	incoming := Stream{
+		Hash:        1,
+		LastSeenAt:  20,
+		TotalSize:   150,
+		RateBuckets: []RateBucket{{Timestamp: 0, Size: 150}, {Timestamp: 10, Size: 50}},
+	}
+
+	once := mergeImportedStream(base, true, incoming)
+	if once.LastSeenAt != 20 {
+		t.Errorf("LastSeenAt = %d, want max(10, 20) = 20", once.LastSeenAt)
+	}
+	if once.TotalSize != 150 {
+		t.Errorf("TotalSize = %d, want max(100, 150) = 150", once.TotalSize)
+	}
+
+	// A peer that retries a partial Export/Import handoff resends the same
+	// incoming state; merging it again must be a no-op.
+	twice := mergeImportedStream(once, true, incoming)
+	if !reflect.DeepEqual(once, twice) {
+		t.Fatalf("merging the same incoming stream twice is not idempotent: once=%+v twice=%+v", once, twice)
+	}
+}
+
+func TestMergeImportedStreamNotFound(t *testing.T) {
+	incoming := Stream{Hash: 1, LastSeenAt: 5, TotalSize: 10, RateBuckets: []RateBucket{{Timestamp: 0, Size: 10}}}
+
+	merged := mergeImportedStream(Stream{}, false, incoming)
+	if !reflect.DeepEqual(merged, incoming) {
+		t.Fatalf("merging into an absent stream should just return incoming, got %+v", merged)
+	}
+}
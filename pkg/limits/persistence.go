@@ -0,0 +1,534 @@
+package limits
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PersistenceConfig configures the optional snapshot + WAL persistence for a
+// streamMetadata instance. Persistence is disabled when Dir is empty.
+type PersistenceConfig struct {
+	// Dir is the local directory snapshots and the WAL are written to.
+	Dir string
+	// SnapshotInterval is how often a full snapshot is taken and the WAL is
+	// truncated. A zero value disables periodic snapshotting; the WAL alone
+	// is still replayed on restore.
+	SnapshotInterval time.Duration
+}
+
+const (
+	snapshotFileName = "streammetadata.snapshot"
+	snapshotTmpName  = snapshotFileName + ".tmp"
+	walFileName      = "streammetadata.wal"
+
+	snapshotMagicV1 uint32 = 0x534c4b31 // "SLK1": stream records have no WindowEnd field
+	snapshotMagic   uint32 = 0x534c4b32 // "SLK2": stream records now include WindowEnd
+)
+
+// persistence owns the snapshot and WAL files backing a streamMetadata
+// instance. All exported methods are safe to call concurrently.
+type persistence struct {
+	dir      string
+	interval time.Duration
+
+	mu  sync.Mutex
+	wal *os.File
+
+	started  bool
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func newPersistence(cfg PersistenceConfig) (*persistence, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating persistence directory: %w", err)
+	}
+
+	wal, err := os.OpenFile(filepath.Join(cfg.Dir, walFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening WAL: %w", err)
+	}
+
+	return &persistence{
+		dir:      cfg.Dir,
+		interval: cfg.SnapshotInterval,
+		wal:      wal,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}, nil
+}
+
+func (p *persistence) snapshotPath() string {
+	return filepath.Join(p.dir, snapshotFileName)
+}
+
+func (p *persistence) walPath() string {
+	return filepath.Join(p.dir, walFileName)
+}
+
+// restore loads the newest snapshot, if any, and then replays the WAL on top
+// of it, keeping only the partitions in assigned. An empty assigned map
+// disables filtering. It runs before s is served, so it touches shards and
+// their sub-stores directly, without taking any lock.
+func (p *persistence) restore(s *streamMetadata, assigned map[int32]struct{}) error {
+	if err := p.loadSnapshot(s, assigned); err != nil {
+		return fmt.Errorf("loading snapshot: %w", err)
+	}
+	if err := p.replayWAL(s, assigned); err != nil {
+		return fmt.Errorf("replaying WAL: %w", err)
+	}
+	s.seedActiveCounters()
+	return nil
+}
+
+func (p *persistence) loadSnapshot(s *streamMetadata, assigned map[int32]struct{}) error {
+	f, err := os.Open(p.snapshotPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	var magic uint32
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+		if isTruncated(err) {
+			return nil
+		}
+		return err
+	}
+	// SLK1 snapshots, written before the sliding-window rate ring was added,
+	// have no WindowEnd field; their streams load with it defaulting to 0,
+	// same as any other stream that predates ring-based rate accounting. An
+	// unrecognized magic is treated as no snapshot at all rather than
+	// failing startup, since a corrupt or foreign file here should not be
+	// fatal when the WAL alone can still bring state mostly up to date.
+	hasWindowEnd := true
+	switch magic {
+	case snapshotMagic:
+	case snapshotMagicV1:
+		hasWindowEnd = false
+	default:
+		return nil
+	}
+
+	for {
+		tenant, partitionID, stream, err := readStreamRecord(r, hasWindowEnd)
+		if isTruncated(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !partitionAssigned(assigned, partitionID) {
+			continue
+		}
+		s.applyLoaded(tenant, partitionID, stream)
+	}
+}
+
+func (p *persistence) replayWAL(s *streamMetadata, assigned map[int32]struct{}) error {
+	f, err := os.Open(p.walPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		tenant, partitionID, update, err := readWALRecord(r)
+		if isTruncated(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !partitionAssigned(assigned, partitionID) {
+			continue
+		}
+		shard := s.getOrCreateShardUnsynchronized(tenant)
+		shard.storeOne(partitionID, update.streamHash, update.recTotalSize, update.recordTime, update.bucketStart, update.bucketCutOff, nil, s.rateWindow)
+	}
+}
+
+// applyLoaded inserts a stream restored from the snapshot directly into the
+// relevant shard. It must only be called before the streamMetadata is
+// served, i.e. without taking any lock.
+func (s *streamMetadata) applyLoaded(tenant string, partitionID int32, stream Stream) {
+	shard := s.getOrCreateShardUnsynchronized(tenant)
+	j := shard.subStripeFor(stream.Hash)
+	if shard.subStores[j][partitionID] == nil {
+		shard.subStores[j][partitionID] = make(map[uint64]Stream)
+	}
+	shard.subStores[j][partitionID][stream.Hash] = stream
+}
+
+// getOrCreateShardUnsynchronized is like getOrCreateShard, but skips locking
+// entirely. It must only be used before s is served to any other goroutine.
+func (s *streamMetadata) getOrCreateShardUnsynchronized(tenant string) *tenantShard {
+	i := s.getStripe(tenant)
+	shard, ok := s.stripes[i][tenant]
+	if !ok {
+		shard = newTenantShard(s.subStripes)
+		s.stripes[i][tenant] = shard
+	}
+	return shard
+}
+
+// seedActiveCounters initializes each shard's per-partition active-stream
+// counters by counting every stream just restored, matching what the live
+// increment path in storeOne counts, so StoreCond's limit accounting does
+// not silently reset (or shift) across a restart.
+func (s *streamMetadata) seedActiveCounters() {
+	for i := range s.stripes {
+		for _, shard := range s.stripes[i] {
+			counts := make(map[int32]int64)
+			for _, streams := range shard.subStores {
+				for partitionID, byHash := range streams {
+					counts[partitionID] += int64(len(byHash))
+				}
+			}
+			for partitionID, n := range counts {
+				*shard.activeCounter(partitionID) = n
+			}
+		}
+	}
+}
+
+func partitionAssigned(assigned map[int32]struct{}, partitionID int32) bool {
+	if len(assigned) == 0 {
+		return true
+	}
+	_, ok := assigned[partitionID]
+	return ok
+}
+
+// snapshotLoop periodically snapshots s and rotates out the portion of the
+// WAL the snapshot covers. It runs until stopCh is closed.
+func (p *persistence) snapshotLoop(s *streamMetadata) {
+	defer close(p.doneCh)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			offset, err := p.writeSnapshot(s)
+			if err == nil {
+				_ = p.rotateWAL(offset)
+			}
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// writeSnapshot writes every stream currently in s to a new snapshot file
+// and returns the WAL offset the snapshot reflects. The scan runs under
+// s.withAllLocked, which blocks every Store/StoreCond/StoreBatch call for
+// its duration: without that, All's per-sub-stripe locking lets a write
+// land in between two sub-stripes the scan has already visited, so neither
+// the recorded WAL offset nor "everything at/after it" would reliably line
+// up with what the scan actually captured, and replay would either drop or
+// double-apply that write (see rotateWAL and replayWAL). Pausing writes for
+// the scan trades a brief stall for that guarantee.
+func (p *persistence) writeSnapshot(s *streamMetadata) (int64, error) {
+	tmpPath := filepath.Join(p.dir, snapshotTmpName)
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, fmt.Errorf("creating snapshot tmp file: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	if err := binary.Write(w, binary.LittleEndian, snapshotMagic); err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	var offset int64
+	var writeErr error
+	s.withAllLocked(func() {
+		offset, writeErr = p.walSize()
+		if writeErr != nil {
+			return
+		}
+		for i := range s.stripes {
+			for tenant, shard := range s.stripes[i] {
+				for _, streams := range shard.subStores {
+					for partitionID, byHash := range streams {
+						for _, stream := range byHash {
+							if writeErr != nil {
+								continue
+							}
+							writeErr = writeStreamRecord(w, tenant, partitionID, stream)
+						}
+					}
+				}
+			}
+		}
+	})
+	if writeErr != nil {
+		f.Close()
+		return 0, writeErr
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, p.snapshotPath()); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// walSize returns the current size of the WAL file.
+func (p *persistence) walSize() (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, err := p.wal.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// rotateWAL drops the WAL bytes before offset, which a snapshot just made
+// redundant, while keeping anything appended at or after it. The WAL is
+// opened with O_APPEND, which always writes at the current end of file
+// regardless of any Seek, so the retained tail cannot be rewritten in
+// place: instead it is copied into a fresh file that atomically replaces
+// the old one, and the open handle is swapped to it.
+func (p *persistence) rotateWAL(offset int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := p.wal.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	tail, err := io.ReadAll(p.wal)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(p.dir, walFileName+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(tail); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, p.walPath()); err != nil {
+		return err
+	}
+
+	if err := p.wal.Close(); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(p.walPath(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	p.wal = wal
+	return nil
+}
+
+// storeUpdate is the WAL-replayable form of a single Store call.
+type storeUpdate struct {
+	streamHash   uint64
+	recTotalSize uint64
+	recordTime   int64
+	bucketStart  int64
+	bucketCutOff int64
+}
+
+func (p *persistence) appendStore(tenant string, partitionID int32, streamHash, recTotalSize uint64, recordTime, bucketStart, bucketCutOff int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w := bufio.NewWriter(p.wal)
+	if err := writeString(w, tenant); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, partitionID); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, streamHash); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, recTotalSize); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, recordTime); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bucketStart); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bucketCutOff); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func readWALRecord(r io.Reader) (string, int32, storeUpdate, error) {
+	tenant, err := readString(r)
+	if err != nil {
+		return "", 0, storeUpdate{}, err
+	}
+	var partitionID int32
+	if err := binary.Read(r, binary.LittleEndian, &partitionID); err != nil {
+		return "", 0, storeUpdate{}, err
+	}
+	var u storeUpdate
+	if err := binary.Read(r, binary.LittleEndian, &u.streamHash); err != nil {
+		return "", 0, storeUpdate{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &u.recTotalSize); err != nil {
+		return "", 0, storeUpdate{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &u.recordTime); err != nil {
+		return "", 0, storeUpdate{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &u.bucketStart); err != nil {
+		return "", 0, storeUpdate{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &u.bucketCutOff); err != nil {
+		return "", 0, storeUpdate{}, err
+	}
+	return tenant, partitionID, u, nil
+}
+
+func writeStreamRecord(w io.Writer, tenant string, partitionID int32, stream Stream) error {
+	if err := writeString(w, tenant); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, partitionID); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, stream.Hash); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, stream.LastSeenAt); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, stream.TotalSize); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(stream.RateBuckets))); err != nil {
+		return err
+	}
+	for _, b := range stream.RateBuckets {
+		if err := binary.Write(w, binary.LittleEndian, b.Timestamp); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, b.Size); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, stream.WindowEnd)
+}
+
+// readStreamRecord reads one stream record written by writeStreamRecord.
+// hasWindowEnd must be false for records written under the SLK1 snapshot
+// format, which predates the WindowEnd field; it is left at its zero value
+// in that case.
+func readStreamRecord(r io.Reader, hasWindowEnd bool) (string, int32, Stream, error) {
+	tenant, err := readString(r)
+	if err != nil {
+		return "", 0, Stream{}, err
+	}
+	var partitionID int32
+	if err := binary.Read(r, binary.LittleEndian, &partitionID); err != nil {
+		return "", 0, Stream{}, err
+	}
+
+	var stream Stream
+	if err := binary.Read(r, binary.LittleEndian, &stream.Hash); err != nil {
+		return "", 0, Stream{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &stream.LastSeenAt); err != nil {
+		return "", 0, Stream{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &stream.TotalSize); err != nil {
+		return "", 0, Stream{}, err
+	}
+
+	var numBuckets uint32
+	if err := binary.Read(r, binary.LittleEndian, &numBuckets); err != nil {
+		return "", 0, Stream{}, err
+	}
+	stream.RateBuckets = make([]RateBucket, numBuckets)
+	for i := range stream.RateBuckets {
+		if err := binary.Read(r, binary.LittleEndian, &stream.RateBuckets[i].Timestamp); err != nil {
+			return "", 0, Stream{}, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &stream.RateBuckets[i].Size); err != nil {
+			return "", 0, Stream{}, err
+		}
+	}
+	if hasWindowEnd {
+		if err := binary.Read(r, binary.LittleEndian, &stream.WindowEnd); err != nil {
+			return "", 0, Stream{}, err
+		}
+	}
+	return tenant, partitionID, stream, nil
+}
+
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// isTruncated reports whether err indicates a clean or partial end of file,
+// both of which are expected when reading the tail of a snapshot or WAL.
+func isTruncated(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
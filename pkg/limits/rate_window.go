@@ -0,0 +1,167 @@
+package limits
+
+import "time"
+
+// RateWindowConfig selects and tunes the sliding-window rate accounting
+// implementation for a StreamMetadata. When Enabled is false (the default),
+// Store and friends keep using the externally bucketed RateBuckets scheme,
+// and Rate always returns ok=false.
+//
+// When enabled, each stream's RateBuckets is instead used as a fixed-size
+// ring of SubBuckets sub-buckets spanning Window, so the reported rate no
+// longer depends on the caller's choice of bucket alignment the way the
+// fixed-timestamp-bucket scheme does.
+type RateWindowConfig struct {
+	Enabled bool
+	// Window is the duration the rate is averaged over.
+	Window time.Duration
+	// SubBuckets is the number of ring slots Window is divided into. 10 is a
+	// reasonable default: each slot is 10% of Window, so the oldest and
+	// newest partial slots contribute at most 10% error each to the rate.
+	SubBuckets int
+}
+
+// bucketDuration returns the width of one ring slot, in the same unit as
+// the int64 timestamps passed to Store (seconds), clamped to at least one
+// second so a zero or misconfigured Window/SubBuckets cannot divide by zero.
+func (cfg RateWindowConfig) bucketDuration() int64 {
+	d := int64(cfg.Window/time.Second) / int64(cfg.SubBuckets)
+	if d < 1 {
+		d = 1
+	}
+	return d
+}
+
+// ringIndex returns the ring slot a sub-bucket starting at bucketStart
+// belongs in.
+func ringIndex(bucketStart, bucketDuration int64, n int) int {
+	return int((bucketStart / bucketDuration) % int64(n))
+}
+
+// mergeStreamRing applies a single store update to recorded under the ring
+// scheme: recorded.RateBuckets is treated as a ring of cfg.SubBuckets slots,
+// each bucketDuration wide, and recorded.WindowEnd tracks the end of the
+// most recently written slot. Slots the ring has rotated past since the
+// last update are cleared before the new update is folded in, so a stream
+// that falls silent and then resumes does not carry stale bytes forward.
+func mergeStreamRing(recorded Stream, ok bool, streamHash, recTotalSize uint64, recordTime int64, cfg RateWindowConfig) Stream {
+	bucketDuration := cfg.bucketDuration()
+	bucketStart := recordTime - recordTime%bucketDuration
+	bucketEnd := bucketStart + bucketDuration
+	idx := ringIndex(bucketStart, bucketDuration, cfg.SubBuckets)
+
+	if !ok {
+		buckets := make([]RateBucket, cfg.SubBuckets)
+		buckets[idx] = RateBucket{Timestamp: bucketStart, Size: recTotalSize}
+		return Stream{
+			Hash:        streamHash,
+			LastSeenAt:  recordTime,
+			TotalSize:   recTotalSize,
+			RateBuckets: buckets,
+			WindowEnd:   bucketEnd,
+		}
+	}
+
+	buckets := recorded.RateBuckets
+	if len(buckets) != cfg.SubBuckets {
+		// The ring wasn't built for this SubBuckets count, e.g. it was
+		// written under a different RateWindowConfig. Start it over rather
+		// than index out of range.
+		buckets = make([]RateBucket, cfg.SubBuckets)
+	} else {
+		buckets = append([]RateBucket(nil), buckets...)
+	}
+
+	if recorded.WindowEnd == 0 {
+		buckets = make([]RateBucket, cfg.SubBuckets)
+	} else if elapsed := (bucketEnd - recorded.WindowEnd) / bucketDuration; elapsed > 0 {
+		n := elapsed
+		if n > int64(cfg.SubBuckets) {
+			n = int64(cfg.SubBuckets)
+		}
+		for step := int64(0); step < n; step++ {
+			clearIdx := ringIndex(bucketStart-step*bucketDuration, bucketDuration, cfg.SubBuckets)
+			buckets[clearIdx] = RateBucket{}
+		}
+	}
+
+	buckets[idx].Timestamp = bucketStart
+	buckets[idx].Size += recTotalSize
+
+	recorded.TotalSize += recTotalSize
+	recorded.LastSeenAt = recordTime
+	recorded.RateBuckets = buckets
+	recorded.WindowEnd = bucketEnd
+	return recorded
+}
+
+// computeRate returns stream's byte rate over cfg.Window as of now: the sum
+// of each ring slot's Size, weighted by how much of that slot actually
+// falls within [now-Window, now], divided by Window. A slot entirely
+// within the window contributes its full Size; the newest, still
+// in-progress slot is weighted by (now-slot.Start)/bucketDuration, and a
+// slot about to roll out of the window is weighted by the remainder of it
+// still inside [now-Window, now].
+func computeRate(stream Stream, now int64, cfg RateWindowConfig) float64 {
+	if len(stream.RateBuckets) == 0 {
+		return 0
+	}
+
+	bucketDuration := cfg.bucketDuration()
+	windowStart := now - int64(cfg.Window/time.Second)
+
+	var total float64
+	for _, b := range stream.RateBuckets {
+		if b.Size == 0 {
+			continue
+		}
+		bucketEnd := b.Timestamp + bucketDuration
+
+		overlapStart := b.Timestamp
+		if windowStart > overlapStart {
+			overlapStart = windowStart
+		}
+		overlapEnd := bucketEnd
+		if now < overlapEnd {
+			overlapEnd = now
+		}
+		if overlapEnd <= overlapStart {
+			continue
+		}
+
+		total += float64(b.Size) * (float64(overlapEnd-overlapStart) / float64(bucketDuration))
+	}
+
+	return total / cfg.Window.Seconds()
+}
+
+// trimStaleRing clears stream's ring in place if its newest slot has aged
+// out of the window entirely, i.e. it has received no traffic for a whole
+// Window. The stream itself is left alone; only its rate data is reset, so
+// a subsequent Rate call correctly reports zero instead of a stale number
+// from before the silence.
+func trimStaleRing(stream Stream, cutoff int64, cfg RateWindowConfig) Stream {
+	if stream.WindowEnd == 0 || stream.WindowEnd+int64(cfg.Window/time.Second) >= cutoff {
+		return stream
+	}
+	stream.RateBuckets = nil
+	stream.WindowEnd = 0
+	return stream
+}
+
+// streamRateExceeded returns a CondFunc that rejects streams whose rate, as
+// reported by rate, exceeds limit bytes/sec, recording their hash in
+// results alongside streamLimitExceeded-style rejections. rate is typically
+// StreamMetadata.Rate bound to the tenant being checked; streams rate
+// cannot yet report on (e.g. ones just created by this very call) are not
+// rejected.
+func streamRateExceeded(limit float64, now int64, rate func(streamHash uint64, now int64) (float64, bool), results map[Reason][]uint64) CondFunc {
+	return func(_ float64, stream Stream) bool {
+		bps, ok := rate(stream.Hash, now)
+		if ok && bps > limit {
+			results[ReasonExceedsMaxRate] = append(results[ReasonExceedsMaxRate], stream.Hash)
+			return false
+		}
+		return true
+	}
+}
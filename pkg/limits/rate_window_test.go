@@ -0,0 +1,79 @@
+package limits
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeStreamRingAccumulatesWithinWindow(t *testing.T) {
+	cfg := RateWindowConfig{Enabled: true, Window: 100 * time.Second, SubBuckets: 10} // 10s buckets
+
+	stream := mergeStreamRing(Stream{}, false, 1, 50, 0, cfg)
+	stream = mergeStreamRing(stream, true, 1, 25, 5, cfg) // same 10s bucket as t=0
+
+	if stream.TotalSize != 75 {
+		t.Fatalf("TotalSize = %d, want 75", stream.TotalSize)
+	}
+
+	rate := computeRate(stream, 5, cfg)
+	// The 75 bytes sit in the single in-progress bucket [0,10); 5s into now
+	// (=now-bucket.Start) only half of it has elapsed, so it is prorated.
+	want := (75.0 * 0.5) / 100.0
+	if rate != want {
+		t.Fatalf("Rate = %v, want %v", rate, want)
+	}
+}
+
+func TestMergeStreamRingClearsSlotsItRotatesPast(t *testing.T) {
+	cfg := RateWindowConfig{Enabled: true, Window: 100 * time.Second, SubBuckets: 10} // 10s buckets
+
+	stream := mergeStreamRing(Stream{}, false, 1, 50, 0, cfg)
+	// Jump forward a whole window: every old slot, including the one just
+	// written, must be cleared rather than left to linger in the ring.
+	stream = mergeStreamRing(stream, true, 1, 10, 100, cfg)
+
+	if stream.TotalSize != 60 {
+		t.Fatalf("TotalSize = %d, want 60 (cumulative, unaffected by ring rotation)", stream.TotalSize)
+	}
+
+	rate := computeRate(stream, 105, cfg)
+	// The old bucket was cleared by the rotation, so only the 5s-elapsed
+	// new bucket contributes.
+	want := (10.0 * 0.5) / 100.0
+	if rate != want {
+		t.Fatalf("Rate = %v, want %v (the rotated-out bucket must not contribute)", rate, want)
+	}
+}
+
+func TestComputeRateWeighsPartialBuckets(t *testing.T) {
+	cfg := RateWindowConfig{Enabled: true, Window: 100 * time.Second, SubBuckets: 10} // 10s buckets
+
+	stream := mergeStreamRing(Stream{}, false, 1, 100, 0, cfg) // bucket [0,10)
+
+	// now=105: the window is [5,105). The [0,10) bucket now only half
+	// overlaps the window, so it should contribute half its bytes.
+	rate := computeRate(stream, 105, cfg)
+	want := (100.0 * 0.5) / 100.0
+	if rate != want {
+		t.Fatalf("Rate = %v, want %v", rate, want)
+	}
+}
+
+func TestTrimStaleRingClearsFullyExpiredWindow(t *testing.T) {
+	cfg := RateWindowConfig{Enabled: true, Window: 100 * time.Second, SubBuckets: 10}
+
+	stream := mergeStreamRing(Stream{}, false, 1, 100, 0, cfg)
+
+	// now=201 is more than a full Window past WindowEnd(10): the ring has
+	// gone completely silent and must be cleared.
+	stream = trimStaleRing(stream, 201, cfg)
+	if stream.WindowEnd != 0 || stream.RateBuckets != nil {
+		t.Fatalf("expected a fully stale ring to be cleared, got WindowEnd=%d RateBuckets=%v", stream.WindowEnd, stream.RateBuckets)
+	}
+
+	fresh := mergeStreamRing(Stream{}, false, 1, 100, 0, cfg)
+	untouched := trimStaleRing(fresh, 50, cfg)
+	if untouched.WindowEnd == 0 {
+		t.Fatal("expected a ring still within its window to be left alone")
+	}
+}
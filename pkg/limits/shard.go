@@ -0,0 +1,142 @@
+package limits
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// tenantShard holds one tenant's stream metadata, split into subStripes
+// sub-stripes keyed by streamHash % len(subStores). Store/StoreCond take
+// only the sub-stripe lock for the stream hash they touch, so producers for
+// the same tenant but different streams can proceed in parallel; All/Usage
+// still need to see every stream, so they visit every sub-stripe in turn.
+type tenantShard struct {
+	subLocks  []stripeLock
+	subStores []map[int32]map[uint64]Stream // partitionID -> streamHash -> Stream
+
+	// active holds, per partitionID, a count of every stream currently
+	// present: incremented by storeOne whenever it creates a stream that
+	// was not already in the map, decremented by evict for every stream it
+	// removes. Store, StoreBatch, and StoreCond all funnel through
+	// storeOne, so the increment and decrement sides always track the same
+	// set of streams regardless of which of them added a given stream.
+	active sync.Map // int32 -> *int64
+}
+
+func newTenantShard(subStripes int) *tenantShard {
+	t := &tenantShard{
+		subLocks:  make([]stripeLock, subStripes),
+		subStores: make([]map[int32]map[uint64]Stream, subStripes),
+	}
+	for i := range t.subStores {
+		t.subStores[i] = make(map[int32]map[uint64]Stream)
+	}
+	return t
+}
+
+// subStripeFor returns the sub-stripe index for streamHash.
+func (t *tenantShard) subStripeFor(streamHash uint64) int {
+	return int(streamHash % uint64(len(t.subStores)))
+}
+
+// activeCounter returns the active-stream counter for partitionID, creating
+// it if necessary.
+func (t *tenantShard) activeCounter(partitionID int32) *int64 {
+	v, _ := t.active.LoadOrStore(partitionID, new(int64))
+	return v.(*int64)
+}
+
+// storeOne merges a single update into the sub-stripe for streamHash. The
+// caller must hold that sub-stripe's lock. When ring.Enabled, the update is
+// folded into the stream's sliding-window ring instead of the default
+// fixed-timestamp-bucket scheme, and bucketStart/bucketCutOff/scratch are
+// unused. If streamHash is not already present, this is the single place
+// that increments the partition's active counter, so every insertion path
+// (Store, StoreBatch, StoreCond, WAL replay) counts a new stream exactly
+// once, matching evict's unconditional decrement.
+func (t *tenantShard) storeOne(partitionID int32, streamHash, recTotalSize uint64, recordTime, bucketStart, bucketCutOff int64, scratch []RateBucket, ring RateWindowConfig) []RateBucket {
+	j := t.subStripeFor(streamHash)
+	if t.subStores[j][partitionID] == nil {
+		t.subStores[j][partitionID] = make(map[uint64]Stream)
+	}
+
+	recorded, ok := t.subStores[j][partitionID][streamHash]
+	if !ok {
+		atomic.AddInt64(t.activeCounter(partitionID), 1)
+	}
+	if ring.Enabled {
+		t.subStores[j][partitionID][streamHash] = mergeStreamRing(recorded, ok, streamHash, recTotalSize, recordTime, ring)
+		return scratch
+	}
+
+	merged, scratch := mergeStream(recorded, ok, streamHash, recTotalSize, recordTime, bucketStart, bucketCutOff, scratch)
+	t.subStores[j][partitionID][streamHash] = merged
+	return scratch
+}
+
+// forEachRLock executes fn with a shared lock for each sub-stripe.
+func (t *tenantShard) forEachRLock(fn func(streams map[int32]map[uint64]Stream)) {
+	for j := range t.subStores {
+		t.subLocks[j].RLock()
+		fn(t.subStores[j])
+		t.subLocks[j].RUnlock()
+	}
+}
+
+// forEachLock executes fn with an exclusive lock for each sub-stripe.
+func (t *tenantShard) forEachLock(fn func(streams map[int32]map[uint64]Stream)) {
+	for j := range t.subStores {
+		t.subLocks[j].Lock()
+		fn(t.subStores[j])
+		t.subLocks[j].Unlock()
+	}
+}
+
+// empty reports whether every sub-stripe holds no partitions at all.
+func (t *tenantShard) empty() bool {
+	empty := true
+	t.forEachRLock(func(streams map[int32]map[uint64]Stream) {
+		if len(streams) > 0 {
+			empty = false
+		}
+	})
+	return empty
+}
+
+// evict removes every stream last seen before cutoff and returns how many
+// were removed, decrementing the affected partitions' active counters. When
+// ring.Enabled, streams that survive eviction but whose rate ring has gone
+// fully stale (no traffic for a whole ring.Window) have their ring cleared
+// in place, see trimStaleRing.
+func (t *tenantShard) evict(cutoff int64, ring RateWindowConfig) int {
+	var n int
+	t.forEachLock(func(streams map[int32]map[uint64]Stream) {
+		for partitionID, partition := range streams {
+			for streamHash, stream := range partition {
+				if stream.LastSeenAt < cutoff {
+					delete(partition, streamHash)
+					n++
+					atomic.AddInt64(t.activeCounter(partitionID), -1)
+					continue
+				}
+				if ring.Enabled {
+					partition[streamHash] = trimStaleRing(stream, cutoff, ring)
+				}
+			}
+		}
+	})
+	return n
+}
+
+// evictPartitions removes every partition in partitions from every
+// sub-stripe, along with its active counter.
+func (t *tenantShard) evictPartitions(partitions []int32) {
+	t.forEachLock(func(streams map[int32]map[uint64]Stream) {
+		for _, partitionID := range partitions {
+			if _, ok := streams[partitionID]; ok {
+				delete(streams, partitionID)
+				t.active.Delete(partitionID)
+			}
+		}
+	})
+}
@@ -1,8 +1,10 @@
 package limits
 
 import (
+	"fmt"
 	"hash/fnv"
 	"sync"
+	"sync/atomic"
 )
 
 // AllFunc is a function that is called for each stream in the metadata.
@@ -36,11 +38,39 @@ type StreamMetadata interface {
 	// Store updates or creates the stream metadata for a specific tenant and partition.
 	Store(tenant string, partitionID int32, streamHash, recTotalSize uint64, recordTime, bucketStart, bucketCutOff int64)
 
+	// StoreBatch is like Store, but applies many updates for a tenant under
+	// a single stripe lock acquisition. It is intended for producer paths
+	// that can accumulate updates over a short flush window, see Appender.
+	StoreBatch(tenant string, updates []StoreUpdate)
+
 	// Evict removes all streams that have not been seen for a specific time.
 	Evict(cutoff int64) map[string]int
 
 	// EvictPartitions removes all unassigned partitions from the metadata for every tenant.
 	EvictPartitions(partitions []int32)
+
+	// Export returns a deep copy of the stream metadata for the given
+	// partitions, across all tenants. It is used to hand off partition
+	// ownership between replicas ahead of a graceful rebalance, before the
+	// sending replica calls EvictPartitions.
+	Export(partitions []int32) map[string]map[int32]map[uint64]Stream
+
+	// Import merges state previously produced by Export into the metadata.
+	// It is idempotent: a stream present on both sides is merged by taking
+	// the max LastSeenAt and summing the Size of RateBuckets that share a
+	// Timestamp, so retrying a partial transfer does not double-count.
+	Import(state map[string]map[int32]map[uint64]Stream)
+
+	// Close releases any resources held by the implementation, such as an
+	// open WAL file or a running snapshotter goroutine. It is safe to call
+	// on an instance created without persistence.
+	Close() error
+
+	// Rate returns the stream's byte rate as of now, averaged over the
+	// RateWindowConfig the instance was constructed with. It returns
+	// ok=false if the instance was constructed with RateWindowConfig.Enabled
+	// false, or if the stream is not known.
+	Rate(tenant string, streamHash uint64, now int64) (bytesPerSec float64, ok bool)
 }
 
 // Stream represents the metadata for a stream loaded from the kafka topic.
@@ -51,6 +81,13 @@ type Stream struct {
 	LastSeenAt  int64
 	TotalSize   uint64
 	RateBuckets []RateBucket
+
+	// WindowEnd is the end timestamp of the newest RateBuckets slot. It is
+	// only maintained when the owning StreamMetadata was constructed with
+	// RateWindowConfig.Enabled, in which case RateBuckets is a fixed-size
+	// ring rather than a variable-length list of seen bucket starts; see
+	// mergeStreamRing.
+	WindowEnd int64
 }
 
 // RateBucket represents the bytes received during a specific time interval
@@ -66,37 +103,136 @@ type stripeLock struct {
 	_ [40]byte
 }
 
+// defaultSubStripes is the number of per-tenant sub-stripes used when a
+// caller does not care to tune it.
+const defaultSubStripes = 16
+
 type streamMetadata struct {
-	stripes []map[string]map[int32]map[uint64]Stream // stripe -> tenant -> partitionID -> streamMetadata
-	locks   []stripeLock
+	stripes []map[string]*tenantShard // stripe -> tenant -> tenantShard
+	locks   []stripeLock              // guards each stripe's tenant -> tenantShard map
+
+	// subStripes is the number of sub-stripes each tenantShard is created
+	// with, see tenantShard.
+	subStripes int
+
+	// rateWindow selects between the fixed-timestamp-bucket RateBuckets
+	// scheme used by mergeStream (the default) and the sliding-window ring
+	// scheme used by mergeStreamRing. See RateWindowConfig.
+	rateWindow RateWindowConfig
+
+	// persist is non-nil when the instance was created with
+	// NewStreamMetadataWithPersistence. It is consulted from Store and
+	// StoreBatch, which always run under the relevant sub-stripe lock.
+	persist *persistence
+
+	// bucketScratchPool holds reusable *[]RateBucket buffers used by
+	// StoreBatch to compact rate buckets without allocating per update.
+	bucketScratchPool sync.Pool
 }
 
-func NewStreamMetadata(size int) StreamMetadata {
+func newEmptyStreamMetadata(size, subStripes int, rateWindow RateWindowConfig) *streamMetadata {
+	if subStripes < 1 {
+		subStripes = 1
+	}
 	s := &streamMetadata{
-		stripes: make([]map[string]map[int32]map[uint64]Stream, size),
-		locks:   make([]stripeLock, size),
+		stripes:    make([]map[string]*tenantShard, size),
+		locks:      make([]stripeLock, size),
+		subStripes: subStripes,
+		rateWindow: rateWindow,
 	}
 	for i := range s.stripes {
-		s.stripes[i] = make(map[string]map[int32]map[uint64]Stream)
+		s.stripes[i] = make(map[string]*tenantShard)
+	}
+	s.bucketScratchPool.New = func() interface{} {
+		buf := make([]RateBucket, 0, 8)
+		return &buf
 	}
 	return s
 }
 
+// NewStreamMetadata returns a StreamMetadata with size top-level stripes,
+// each holding one tenantShard per tenant hashed to it, further split into
+// subStripes sub-stripes keyed by stream hash (see tenantShard). rateWindow
+// selects the rate accounting scheme Store and Rate use.
+func NewStreamMetadata(size, subStripes int, rateWindow RateWindowConfig) StreamMetadata {
+	return newEmptyStreamMetadata(size, subStripes, rateWindow)
+}
+
+// NewStreamMetadataWithPersistence is like NewStreamMetadata, but restores
+// state from the newest snapshot plus any WAL entries written after it, and
+// keeps persisting subsequent mutations to cfg.Dir. Restored state is
+// filtered to assignedPartitions, so EvictPartitions semantics still hold
+// after a reload; pass a nil or empty slice to restore every partition.
+//
+// The returned StreamMetadata must be closed to stop the background
+// snapshotter and release the WAL file.
+func NewStreamMetadataWithPersistence(size, subStripes int, rateWindow RateWindowConfig, cfg PersistenceConfig, assignedPartitions []int32) (StreamMetadata, error) {
+	s := newEmptyStreamMetadata(size, subStripes, rateWindow)
+
+	if cfg.Dir == "" {
+		return s, nil
+	}
+
+	p, err := newPersistence(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	assigned := make(map[int32]struct{}, len(assignedPartitions))
+	for _, partitionID := range assignedPartitions {
+		assigned[partitionID] = struct{}{}
+	}
+
+	if err := p.restore(s, assigned); err != nil {
+		_ = p.wal.Close()
+		return nil, fmt.Errorf("restoring stream metadata: %w", err)
+	}
+
+	s.persist = p
+	if cfg.SnapshotInterval > 0 {
+		p.started = true
+		go p.snapshotLoop(s)
+	}
+	return s, nil
+}
+
+// Close implements StreamMetadata.
+func (s *streamMetadata) Close() error {
+	if s.persist == nil {
+		return nil
+	}
+	if s.persist.started {
+		s.persist.stopOnce.Do(func() { close(s.persist.stopCh) })
+		<-s.persist.doneCh
+	}
+	return s.persist.wal.Close()
+}
+
 func (s *streamMetadata) All(fn AllFunc) {
 	s.forEachRLock(func(i int) {
-		for tenant, partitions := range s.stripes[i] {
-			for partitionID, partition := range partitions {
-				for _, stream := range partition {
-					fn(tenant, partitionID, stream)
+		for tenant, shard := range s.stripes[i] {
+			shard.forEachRLock(func(streams map[int32]map[uint64]Stream) {
+				for partitionID, partition := range streams {
+					for _, stream := range partition {
+						fn(tenant, partitionID, stream)
+					}
 				}
-			}
+			})
 		}
 	})
 }
 
 func (s *streamMetadata) Usage(tenant string, fn UsageFunc) {
+	var shard *tenantShard
 	s.withRLock(tenant, func(i int) {
-		for partitionID, partition := range s.stripes[i][tenant] {
+		shard = s.stripes[i][tenant]
+	})
+	if shard == nil {
+		return
+	}
+
+	shard.forEachRLock(func(streams map[int32]map[uint64]Stream) {
+		for partitionID, partition := range streams {
 			for _, stream := range partition {
 				fn(partitionID, stream)
 			}
@@ -104,87 +240,170 @@ func (s *streamMetadata) Usage(tenant string, fn UsageFunc) {
 	})
 }
 
-func (s *streamMetadata) StoreCond(tenant string, streams map[int32][]Stream, cutoff, bucketStart, bucketCutOff int64, cond CondFunc) uint64 {
-	var ingestedBytes uint64
-	s.withLock(tenant, func(i int) {
-		if _, ok := s.stripes[i][tenant]; !ok {
-			s.stripes[i][tenant] = make(map[int32]map[uint64]Stream)
-		}
+// Rate implements StreamMetadata.
+func (s *streamMetadata) Rate(tenant string, streamHash uint64, now int64) (float64, bool) {
+	if !s.rateWindow.Enabled {
+		return 0, false
+	}
 
-		for partitionID, streams := range streams {
-			if _, ok := s.stripes[i][tenant][partitionID]; !ok {
-				s.stripes[i][tenant][partitionID] = make(map[uint64]Stream)
-			}
+	var shard *tenantShard
+	s.withRLock(tenant, func(i int) {
+		shard = s.stripes[i][tenant]
+	})
+	if shard == nil {
+		return 0, false
+	}
 
-			var (
-				activeStreams = 0
-				newStreams    = 0
-			)
+	j := shard.subStripeFor(streamHash)
+	shard.subLocks[j].RLock()
+	defer shard.subLocks[j].RUnlock()
 
-			// Count as active streams all stream that are not expired.
-			for _, stored := range s.stripes[i][tenant][partitionID] {
-				if stored.LastSeenAt >= cutoff {
-					activeStreams++
-				}
-			}
+	for _, byHash := range shard.subStores[j] {
+		if stream, ok := byHash[streamHash]; ok {
+			return computeRate(stream, now, s.rateWindow), true
+		}
+	}
+	return 0, false
+}
 
-			for _, stream := range streams {
-				stored, found := s.stripes[i][tenant][partitionID][stream.Hash]
+// StoreCond implements StreamMetadata. The active-stream count used for cond
+// is a per-partition counter maintained incrementally (see tenantShard),
+// rather than a scan of every stream under the tenant lock, so each update
+// only needs the sub-stripe lock for its own stream hash.
+func (s *streamMetadata) StoreCond(tenant string, streams map[int32][]Stream, cutoff, bucketStart, bucketCutOff int64, cond CondFunc) uint64 {
+	shard := s.getOrCreateShard(tenant)
 
-				// If the stream is new or expired, check if it exceeds the limit.
-				// If limit is not exceeded and the stream is expired, reset the stream.
-				if !found || (stored.LastSeenAt < cutoff) {
-					// Count up the new stream before updating
-					newStreams++
+	var ingestedBytes uint64
+	for partitionID, partitionStreams := range streams {
+		counter := shard.activeCounter(partitionID)
 
-					if !cond(float64(activeStreams+newStreams), stream) {
-						continue
-					}
+		for _, stream := range partitionStreams {
+			j := shard.subStripeFor(stream.Hash)
+			shard.subLocks[j].Lock()
 
-					// If the stream is stored and expired, reset the stream
-					if found && stored.LastSeenAt < cutoff {
-						s.stripes[i][tenant][partitionID][stream.Hash] = Stream{Hash: stream.Hash, LastSeenAt: stream.LastSeenAt}
-					}
+			if shard.subStores[j][partitionID] == nil {
+				shard.subStores[j][partitionID] = make(map[uint64]Stream)
+			}
+
+			stored, found := shard.subStores[j][partitionID][stream.Hash]
+			store := true
+
+			// If the stream is new or expired, check if it exceeds the limit.
+			// If limit is not exceeded and the stream is expired, reset it.
+			if !found || stored.LastSeenAt < cutoff {
+				// acc previews the count storeOne would commit below,
+				// without mutating the counter itself: a genuinely new
+				// stream would push it up by one, an expired-but-present
+				// one is already counted and does not.
+				acc := atomic.LoadInt64(counter)
+				if !found {
+					acc++
 				}
 
-				s.storeStream(i, tenant, partitionID, stream.Hash, stream.TotalSize, stream.LastSeenAt, bucketStart, bucketCutOff)
+				if !cond(float64(acc), stream) {
+					store = false
+				} else if found && stored.LastSeenAt < cutoff {
+					shard.subStores[j][partitionID][stream.Hash] = Stream{Hash: stream.Hash, LastSeenAt: stream.LastSeenAt}
+				}
+			}
 
+			if store {
+				shard.storeOne(partitionID, stream.Hash, stream.TotalSize, stream.LastSeenAt, bucketStart, bucketCutOff, nil, s.rateWindow)
 				ingestedBytes += stream.TotalSize
+
+				if s.persist != nil {
+					_ = s.persist.appendStore(tenant, partitionID, stream.Hash, stream.TotalSize, stream.LastSeenAt, bucketStart, bucketCutOff)
+				}
 			}
+
+			shard.subLocks[j].Unlock()
 		}
-	})
+	}
 	return ingestedBytes
 }
 
 func (s *streamMetadata) Store(tenant string, partitionID int32, streamHash, recTotalSize uint64, recordTime, bucketStart, bucketCutOff int64) {
-	s.withLock(tenant, func(i int) {
-		// Initialize tenant map if it doesn't exist
-		if _, ok := s.stripes[i][tenant]; !ok {
-			s.stripes[i][tenant] = make(map[int32]map[uint64]Stream)
-		}
+	shard := s.getOrCreateShard(tenant)
+	j := shard.subStripeFor(streamHash)
+
+	shard.subLocks[j].Lock()
+	shard.storeOne(partitionID, streamHash, recTotalSize, recordTime, bucketStart, bucketCutOff, nil, s.rateWindow)
+	if s.persist != nil {
+		// Best-effort: a failed WAL append does not fail the Store call, it
+		// only means a subsequent restore may miss this update if no further
+		// snapshot is taken.
+		_ = s.persist.appendStore(tenant, partitionID, streamHash, recTotalSize, recordTime, bucketStart, bucketCutOff)
+	}
+	shard.subLocks[j].Unlock()
+}
+
+// StoreUpdate bundles a single stream update for StoreBatch.
+type StoreUpdate struct {
+	PartitionID  int32
+	StreamHash   uint64
+	Size         uint64
+	RecordTime   int64
+	BucketStart  int64
+	BucketCutOff int64
+}
 
-		// Initialize partition map if it doesn't exist
-		if s.stripes[i][tenant][partitionID] == nil {
-			s.stripes[i][tenant][partitionID] = make(map[uint64]Stream)
+// StoreBatch implements StreamMetadata. Updates are grouped by the
+// sub-stripe their StreamHash falls into, so each sub-stripe lock is taken
+// at most once for the whole batch instead of once per update, and a pooled
+// scratch buffer is reused to compact rate buckets instead of allocating one
+// per update. Within a sub-stripe, updates are applied in order, so repeated
+// updates to the same (PartitionID, StreamHash) are merged in place exactly
+// as a sequence of individual Store calls would be.
+func (s *streamMetadata) StoreBatch(tenant string, updates []StoreUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+
+	shard := s.getOrCreateShard(tenant)
+
+	grouped := make(map[int][]StoreUpdate, len(shard.subStores))
+	for _, u := range updates {
+		j := shard.subStripeFor(u.StreamHash)
+		grouped[j] = append(grouped[j], u)
+	}
+
+	scratchPtr := s.bucketScratchPool.Get().(*[]RateBucket)
+	defer s.bucketScratchPool.Put(scratchPtr)
+
+	for j, subUpdates := range grouped {
+		shard.subLocks[j].Lock()
+
+		scratch := (*scratchPtr)[:0]
+		for _, u := range subUpdates {
+			scratch = shard.storeOne(u.PartitionID, u.StreamHash, u.Size, u.RecordTime, u.BucketStart, u.BucketCutOff, scratch[:0], s.rateWindow)
+
+			if s.persist != nil {
+				_ = s.persist.appendStore(tenant, u.PartitionID, u.StreamHash, u.Size, u.RecordTime, u.BucketStart, u.BucketCutOff)
+			}
 		}
+		*scratchPtr = scratch[:0]
 
-		s.storeStream(i, tenant, partitionID, streamHash, recTotalSize, recordTime, bucketStart, bucketCutOff)
-	})
+		shard.subLocks[j].Unlock()
+	}
 }
 
-func (s *streamMetadata) storeStream(i int, tenant string, partitionID int32, streamHash, recTotalSize uint64, recordTime, bucketStart, bucketCutOff int64) {
-	// Check if the stream already exists in the metadata
-	recorded, ok := s.stripes[i][tenant][partitionID][streamHash]
-
+// mergeStream applies a single store update on top of recorded, which is the
+// stream's current metadata and whether it was found in the map. It is the
+// single place that implements Store's merge semantics so that it can also
+// be used to replay WAL entries during recovery and to compact rate buckets
+// in StoreBatch. scratch, if non-nil, is reused as the backing array for the
+// returned stream's rate buckets are built in (the returned Stream always
+// owns its own copy, so scratch can be reused for the next call); pass nil
+// to let it allocate as Store does.
+func mergeStream(recorded Stream, ok bool, streamHash, recTotalSize uint64, recordTime, bucketStart, bucketCutOff int64, scratch []RateBucket) (Stream, []RateBucket) {
 	// Create new stream metadata with the initial interval
 	if !ok {
-		s.stripes[i][tenant][partitionID][streamHash] = Stream{
+		return Stream{
 			Hash:        streamHash,
 			LastSeenAt:  recordTime,
 			TotalSize:   recTotalSize,
 			RateBuckets: []RateBucket{{Timestamp: bucketStart, Size: recTotalSize}},
-		}
-		return
+		}, scratch
 	}
 
 	// Update total size
@@ -192,7 +411,10 @@ func (s *streamMetadata) storeStream(i int, tenant string, partitionID int32, st
 
 	// Update or add size for the current bucket
 	updated := false
-	sb := make([]RateBucket, 0, len(recorded.RateBuckets)+1)
+	sb := scratch[:0]
+	if sb == nil {
+		sb = make([]RateBucket, 0, len(recorded.RateBuckets)+1)
+	}
 
 	// Only keep buckets within the rate window and update the current bucket
 	for _, bucket := range recorded.RateBuckets {
@@ -223,21 +445,26 @@ func (s *streamMetadata) storeStream(i int, tenant string, partitionID int32, st
 	}
 
 	recorded.TotalSize = totalSize
-	recorded.RateBuckets = sb
-	s.stripes[i][tenant][partitionID][streamHash] = recorded
+	if scratch != nil {
+		// sb's backing array is the caller's pooled scratch buffer, reused
+		// across calls, so the stored stream needs its own copy.
+		recorded.RateBuckets = append([]RateBucket(nil), sb...)
+	} else {
+		// sb was freshly allocated for this call alone, so it can be handed
+		// to the stored stream directly without an extra copy.
+		recorded.RateBuckets = sb
+	}
+	return recorded, sb
 }
 
+// Evict implements StreamMetadata. It only needs the shared top-level stripe
+// lock, since each tenantShard's own sub-stripe locks protect the deletions.
 func (s *streamMetadata) Evict(cutoff int64) map[string]int {
 	evicted := make(map[string]int)
-	s.forEachLock(func(i int) {
-		for tenant, streams := range s.stripes[i] {
-			for partitionID, partition := range streams {
-				for streamHash, stream := range partition {
-					if stream.LastSeenAt < cutoff {
-						delete(s.stripes[i][tenant][partitionID], streamHash)
-						evicted[tenant]++
-					}
-				}
+	s.forEachRLock(func(i int) {
+		for tenant, shard := range s.stripes[i] {
+			if n := shard.evict(cutoff, s.rateWindow); n > 0 {
+				evicted[tenant] += n
 			}
 		}
 	})
@@ -245,18 +472,175 @@ func (s *streamMetadata) Evict(cutoff int64) map[string]int {
 }
 
 func (s *streamMetadata) EvictPartitions(partitions []int32) {
+	s.forEachRLock(func(i int) {
+		for _, shard := range s.stripes[i] {
+			shard.evictPartitions(partitions)
+		}
+	})
+
+	// Drop tenants left with no partitions at all. This is a second, coarser
+	// pass under the exclusive stripe lock; a tenant that receives a fresh
+	// Store call for an unrelated partition in the narrow window between the
+	// two passes is rare and self-heals on its next write.
 	s.forEachLock(func(i int) {
-		for tenant, tenantPartitions := range s.stripes[i] {
-			for _, deleteID := range partitions {
-				delete(tenantPartitions, deleteID)
-			}
-			if len(tenantPartitions) == 0 {
+		for tenant, shard := range s.stripes[i] {
+			if shard.empty() {
 				delete(s.stripes[i], tenant)
 			}
 		}
 	})
 }
 
+// Export implements StreamMetadata.
+func (s *streamMetadata) Export(partitions []int32) map[string]map[int32]map[uint64]Stream {
+	wanted := make(map[int32]struct{}, len(partitions))
+	for _, partitionID := range partitions {
+		wanted[partitionID] = struct{}{}
+	}
+
+	state := make(map[string]map[int32]map[uint64]Stream)
+	s.forEachRLock(func(i int) {
+		for tenant, shard := range s.stripes[i] {
+			shard.forEachRLock(func(streams map[int32]map[uint64]Stream) {
+				for partitionID, byHash := range streams {
+					if _, ok := wanted[partitionID]; !ok || len(byHash) == 0 {
+						continue
+					}
+
+					tenantState, ok := state[tenant]
+					if !ok {
+						tenantState = make(map[int32]map[uint64]Stream)
+						state[tenant] = tenantState
+					}
+					copied, ok := tenantState[partitionID]
+					if !ok {
+						copied = make(map[uint64]Stream, len(byHash))
+						tenantState[partitionID] = copied
+					}
+
+					for streamHash, stream := range byHash {
+						stream.RateBuckets = append([]RateBucket(nil), stream.RateBuckets...)
+						copied[streamHash] = stream
+					}
+				}
+			})
+		}
+	})
+	return state
+}
+
+// Import implements StreamMetadata. Each stream is merged under its own
+// sub-stripe lock, so it can run concurrently with Store/StoreCond traffic
+// for streams that are not part of the handoff, even within the same
+// tenant. Imported partitions' active-stream counters are seeded from the
+// streams newly added by this call, the same way a restore seeds them (see
+// seedActiveCounters), so StoreCond's limit accounting carries over instead
+// of resetting to zero for the receiving replica.
+func (s *streamMetadata) Import(state map[string]map[int32]map[uint64]Stream) {
+	for tenant, partitions := range state {
+		shard := s.getOrCreateShard(tenant)
+
+		for partitionID, streams := range partitions {
+			counter := shard.activeCounter(partitionID)
+
+			for streamHash, incoming := range streams {
+				j := shard.subStripeFor(streamHash)
+				shard.subLocks[j].Lock()
+
+				if shard.subStores[j][partitionID] == nil {
+					shard.subStores[j][partitionID] = make(map[uint64]Stream)
+				}
+				existing, ok := shard.subStores[j][partitionID][streamHash]
+				shard.subStores[j][partitionID][streamHash] = mergeImportedStream(existing, ok, incoming)
+				if !ok {
+					atomic.AddInt64(counter, 1)
+				}
+
+				shard.subLocks[j].Unlock()
+			}
+		}
+	}
+}
+
+// mergeImportedStream combines a stream received via Import with whatever is
+// already stored locally under the same tenant/partition/streamHash, so that
+// replaying the same handoff more than once does not double-count:
+// LastSeenAt, TotalSize, and each Timestamp's RateBucket Size all take the
+// max of both sides, rather than summing, since they are monotonic and a
+// retried transfer resends the same values, not additional ones.
+func mergeImportedStream(existing Stream, ok bool, incoming Stream) Stream {
+	if !ok {
+		return incoming
+	}
+
+	merged := Stream{Hash: incoming.Hash, LastSeenAt: existing.LastSeenAt, TotalSize: existing.TotalSize}
+	if incoming.LastSeenAt > merged.LastSeenAt {
+		merged.LastSeenAt = incoming.LastSeenAt
+	}
+	if incoming.TotalSize > merged.TotalSize {
+		merged.TotalSize = incoming.TotalSize
+	}
+
+	byTimestamp := make(map[int64]uint64, len(existing.RateBuckets)+len(incoming.RateBuckets))
+	order := make([]int64, 0, len(existing.RateBuckets)+len(incoming.RateBuckets))
+	for _, buckets := range [][]RateBucket{existing.RateBuckets, incoming.RateBuckets} {
+		for _, b := range buckets {
+			if _, ok := byTimestamp[b.Timestamp]; !ok {
+				order = append(order, b.Timestamp)
+			}
+			if b.Size > byTimestamp[b.Timestamp] {
+				byTimestamp[b.Timestamp] = b.Size
+			}
+		}
+	}
+
+	merged.RateBuckets = make([]RateBucket, 0, len(order))
+	for _, ts := range order {
+		merged.RateBuckets = append(merged.RateBuckets, RateBucket{Timestamp: ts, Size: byTimestamp[ts]})
+	}
+
+	return merged
+}
+
+// withAllLocked runs fn with every stripe and every shard's every sub-stripe
+// locked exclusively, so no Store/StoreCond/StoreBatch call can be in
+// flight for its duration. This is more expensive than the usual
+// forEachRLock-based scans, which are not point-in-time with respect to
+// concurrent writers; it exists for persistence's snapshot scan, which
+// needs a genuine point-in-time view plus a WAL offset that exactly
+// corresponds to it (see persistence.writeSnapshot).
+func (s *streamMetadata) withAllLocked(fn func()) {
+	for i := range s.locks {
+		s.locks[i].Lock()
+	}
+	defer func() {
+		for i := range s.locks {
+			s.locks[i].Unlock()
+		}
+	}()
+
+	var shards []*tenantShard
+	for i := range s.stripes {
+		for _, shard := range s.stripes[i] {
+			shards = append(shards, shard)
+		}
+	}
+	for _, shard := range shards {
+		for j := range shard.subLocks {
+			shard.subLocks[j].Lock()
+		}
+	}
+	defer func() {
+		for _, shard := range shards {
+			for j := range shard.subLocks {
+				shard.subLocks[j].Unlock()
+			}
+		}
+	}()
+
+	fn()
+}
+
 // forEachRLock executes fn with a shared lock for each stripe.
 func (s *streamMetadata) forEachRLock(fn func(i int)) {
 	for i := range s.stripes {
@@ -298,6 +682,41 @@ func (s *streamMetadata) getStripe(tenant string) int {
 	return int(h.Sum32() % uint32(len(s.locks)))
 }
 
+// getOrCreateShard returns the tenantShard for tenant, creating it if this
+// is the first time the tenant is seen. The fast path only takes the
+// top-level stripe's shared lock.
+func (s *streamMetadata) getOrCreateShard(tenant string) *tenantShard {
+	var shard *tenantShard
+	s.withRLock(tenant, func(i int) {
+		shard = s.stripes[i][tenant]
+	})
+	if shard != nil {
+		return shard
+	}
+
+	s.withLock(tenant, func(i int) {
+		if existing, ok := s.stripes[i][tenant]; ok {
+			shard = existing
+			return
+		}
+		shard = newTenantShard(s.subStripes)
+		s.stripes[i][tenant] = shard
+	})
+	return shard
+}
+
+// Reason identifies why a CondFunc rejected a candidate stream.
+type Reason int
+
+const (
+	// ReasonExceedsMaxStreams means the partition's active-stream limit was
+	// reached; see streamLimitExceeded.
+	ReasonExceedsMaxStreams Reason = iota
+	// ReasonExceedsMaxRate means the stream's byte rate exceeded its limit;
+	// see streamRateExceeded.
+	ReasonExceedsMaxRate
+)
+
 // streamLimitExceeded returns a CondFunc that checks if the number of active streams
 // exceeds the given limit. If it does, the stream is added to the results map.
 func streamLimitExceeded(limit uint64, results map[Reason][]uint64) CondFunc {
@@ -0,0 +1,80 @@
+package limits
+
+import "testing"
+
+// storeCondAccept runs a single-stream StoreCond call against s and reports
+// whether cond accepted it.
+func storeCondAccept(s StreamMetadata, limit float64, hash uint64, lastSeenAt, cutoff int64) bool {
+	accepted := false
+	streams := map[int32][]Stream{0: {{Hash: hash, LastSeenAt: lastSeenAt, TotalSize: 1}}}
+	s.StoreCond("tenant", streams, cutoff, lastSeenAt, lastSeenAt, func(acc float64, _ Stream) bool {
+		accepted = acc <= limit
+		return accepted
+	})
+	return accepted
+}
+
+func TestStoreCondActiveCounterRollsBackOnReject(t *testing.T) {
+	s := NewStreamMetadata(1, 1, RateWindowConfig{})
+	defer s.Close()
+
+	const limit = 2
+	if !storeCondAccept(s, limit, 1, 1, 0) {
+		t.Fatal("expected stream 1 to be accepted under the limit")
+	}
+	if !storeCondAccept(s, limit, 2, 5, 0) {
+		t.Fatal("expected stream 2 to be accepted under the limit")
+	}
+	if storeCondAccept(s, limit, 3, 5, 0) {
+		t.Fatal("expected stream 3 to be rejected once at the limit")
+	}
+
+	// Evict the first stream only (LastSeenAt=1 < cutoff=2); the rejected
+	// candidate above must not have left the active count stuck above the
+	// limit, or this newly freed slot stays unusable forever.
+	s.Evict(2)
+
+	if !storeCondAccept(s, limit, 4, 5, 0) {
+		t.Fatal("expected a new stream to be accepted after eviction freed a slot")
+	}
+}
+
+func TestStoreActiveCounterTracksEvict(t *testing.T) {
+	s := NewStreamMetadata(1, 1, RateWindowConfig{})
+	defer s.Close()
+
+	// Plain Store calls must be counted the same way StoreCond-added streams
+	// are, since evict decrements for every stream it removes regardless of
+	// how it was added: 3 Stores followed by an Evict that removes all 3
+	// must leave the counter at 0, not -3.
+	s.Store("tenant", 0, 1, 1, 1, 1, 1)
+	s.Store("tenant", 0, 2, 1, 5, 5, 5)
+	s.Store("tenant", 0, 3, 1, 5, 5, 5)
+
+	s.Evict(10)
+
+	const limit = 1
+	if !storeCondAccept(s, limit, 4, 20, 0) {
+		t.Fatal("expected a new stream to be accepted after Evict freed every slot Store had used")
+	}
+	if storeCondAccept(s, limit, 5, 20, 0) {
+		t.Fatal("expected a second new stream to be rejected once at the limit; a negative base counter would over-admit")
+	}
+}
+
+func TestStoreCondActiveCounterNoDoubleCountOnReactivation(t *testing.T) {
+	s := NewStreamMetadata(1, 1, RateWindowConfig{})
+	defer s.Close()
+
+	const limit = 1
+	if !storeCondAccept(s, limit, 1, 1, 0) {
+		t.Fatal("expected the first store of stream 1 to be accepted")
+	}
+
+	// cutoff=10 makes stream 1 (LastSeenAt=1) look expired, so this call
+	// takes the reactivation branch for the same stream rather than
+	// treating it as a second one; it must not count twice against limit=1.
+	if !storeCondAccept(s, limit, 1, 20, 10) {
+		t.Fatal("expected reactivating the sole stream to stay within the limit")
+	}
+}